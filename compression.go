@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressionGzip        = "gzip"
+	compressionZstd        = "zstd"
+	compressionZstdChunked = "zstd-chunked"
+)
+
+const mediaTypeZstdLayer = types.MediaType("application/vnd.oci.image.layer.v1.tar+zstd")
+
+// zstd-chunked annotation keys, per the containers/storage convention, so
+// partial-pull-aware clients can locate the trailing chunk manifest without
+// decompressing the whole blob.
+const (
+	zstdChunkManifestChecksumAnnotation = "io.github.containers.zstd-chunked.manifest-checksum"
+	zstdChunkManifestPositionAnnotation = "io.github.containers.zstd-chunked.manifest-position"
+)
+
+// zstdChunkSize is the size, in uncompressed bytes, of each chunk a
+// zstd-chunked layer is split into for the chunk manifest.
+const zstdChunkSize = 4 << 20
+
+// zstdChunk describes one chunk of the *uncompressed* tar stream: its digest
+// and its offset and length in uncompressed bytes. All chunks are compressed
+// into one continuous zstd stream, so these offsets do not map to byte
+// ranges of the compressed blob.
+type zstdChunk struct {
+	Digest string `json:"digest"`
+	Offset int64  `json:"offset"`
+	Length int64  `json:"length"`
+}
+
+// chunkAnnotations is implemented by layers that need extra annotations
+// recorded on their manifest descriptor, such as the zstd-chunked
+// manifest-checksum/manifest-position pair. dedupeImage checks for it
+// optionally via a type assertion.
+type chunkAnnotations interface {
+	ChunkAnnotations() (map[string]string, error)
+}
+
+// compressedLayerFromOpener builds a v1.Layer from opener using the
+// requested compression. gzip keeps using go-containerregistry's own
+// tarball writer; zstd/zstd-chunked go through zstdLayer below since
+// tarball.LayerFromOpener only speaks gzip.
+func compressedLayerFromOpener(opener tarball.Opener, compression string) (v1.Layer, error) {
+	switch compression {
+	case compressionZstd:
+		return &zstdLayer{opener: opener}, nil
+	case compressionZstdChunked:
+		return &zstdLayer{opener: opener, chunked: true}, nil
+	default:
+		return tarball.LayerFromOpener(opener, tarball.WithCompressionLevel(9), tarball.WithCompressedCaching)
+	}
+}
+
+// zstdLayer wraps an uncompressed tar opener and compresses it with zstd on
+// first use, caching the result since v1.Layer methods may be called more
+// than once. When chunked is set, a table of per-chunk SHA-256 digests and
+// offsets is appended as a trailing zstd skippable frame.
+type zstdLayer struct {
+	opener  tarball.Opener
+	chunked bool
+
+	once        sync.Once
+	err         error
+	compressed  []byte
+	diffID      v1.Hash
+	digest      v1.Hash
+	manifestSum string
+	manifestPos int64
+}
+
+func (l *zstdLayer) build() error {
+	l.once.Do(func() {
+		uncompressed, err := l.opener()
+		if err != nil {
+			l.err = err
+			return
+		}
+		defer uncompressed.Close()
+
+		diffIDHasher := sha256.New()
+		teeReader := io.TeeReader(uncompressed, diffIDHasher)
+
+		var compressedBuf bytes.Buffer
+		zstdWriter, err := zstd.NewWriter(&compressedBuf)
+		if err != nil {
+			l.err = err
+			return
+		}
+
+		var chunks []zstdChunk
+		if l.chunked {
+			chunks, err = writeZstdChunks(teeReader, zstdWriter)
+		} else {
+			_, err = io.Copy(zstdWriter, teeReader)
+		}
+		if err != nil {
+			zstdWriter.Close()
+			l.err = err
+			return
+		}
+		if err := zstdWriter.Close(); err != nil {
+			l.err = err
+			return
+		}
+
+		if l.chunked {
+			l.manifestPos = int64(compressedBuf.Len())
+
+			manifestJSON, err := json.Marshal(chunks)
+			if err != nil {
+				l.err = err
+				return
+			}
+			manifestSum := sha256.Sum256(manifestJSON)
+			l.manifestSum = fmt.Sprintf("sha256:%x", manifestSum)
+
+			compressedBuf.Write(zstdSkippableFrame(manifestJSON))
+		}
+
+		l.compressed = compressedBuf.Bytes()
+		l.diffID = v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", diffIDHasher.Sum(nil))}
+		digestSum := sha256.Sum256(l.compressed)
+		l.digest = v1.Hash{Algorithm: "sha256", Hex: fmt.Sprintf("%x", digestSum)}
+	})
+
+	return l.err
+}
+
+// writeZstdChunks copies reader into w in zstdChunkSize pieces, hashing each
+// piece (over its uncompressed bytes) into the returned chunk table.
+func writeZstdChunks(reader io.Reader, w io.Writer) ([]zstdChunk, error) {
+	var chunks []zstdChunk
+	var offset int64
+	buf := make([]byte, zstdChunkSize)
+
+	for {
+		n, readErr := io.ReadFull(reader, buf)
+		if n > 0 {
+			chunkSum := sha256.Sum256(buf[:n])
+			chunks = append(chunks, zstdChunk{
+				Digest: fmt.Sprintf("sha256:%x", chunkSum),
+				Offset: offset,
+				Length: int64(n),
+			})
+			offset += int64(n)
+
+			if _, err := w.Write(buf[:n]); err != nil {
+				return nil, err
+			}
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			return chunks, nil
+		}
+		if readErr != nil {
+			return nil, readErr
+		}
+	}
+}
+
+// zstdSkippableFrame wraps payload in a zstd skippable frame (type 0):
+// magic number + little-endian length + payload. Decoders that don't
+// understand zstd-chunked simply skip over it; containers/storage reads it
+// directly to recover the chunk manifest without decompressing the frame
+// that precedes it.
+func zstdSkippableFrame(payload []byte) []byte {
+	frame := make([]byte, 8+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], 0x184D2A50)
+	binary.LittleEndian.PutUint32(frame[4:8], uint32(len(payload)))
+	copy(frame[8:], payload)
+	return frame
+}
+
+func (l *zstdLayer) Digest() (v1.Hash, error) {
+	if err := l.build(); err != nil {
+		return v1.Hash{}, err
+	}
+	return l.digest, nil
+}
+
+func (l *zstdLayer) DiffID() (v1.Hash, error) {
+	if err := l.build(); err != nil {
+		return v1.Hash{}, err
+	}
+	return l.diffID, nil
+}
+
+func (l *zstdLayer) Size() (int64, error) {
+	if err := l.build(); err != nil {
+		return 0, err
+	}
+	return int64(len(l.compressed)), nil
+}
+
+func (l *zstdLayer) MediaType() (types.MediaType, error) {
+	return mediaTypeZstdLayer, nil
+}
+
+func (l *zstdLayer) Compressed() (io.ReadCloser, error) {
+	if err := l.build(); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(l.compressed)), nil
+}
+
+func (l *zstdLayer) Uncompressed() (io.ReadCloser, error) {
+	return l.opener()
+}
+
+func (l *zstdLayer) ChunkAnnotations() (map[string]string, error) {
+	if err := l.build(); err != nil {
+		return nil, err
+	}
+	if !l.chunked {
+		return nil, nil
+	}
+	return map[string]string{
+		zstdChunkManifestChecksumAnnotation: l.manifestSum,
+		zstdChunkManifestPositionAnnotation: fmt.Sprintf("%d", l.manifestPos),
+	}, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// dedupeImage rewrites a single image's layers, optionally prepending a
+// shared synthetic base layer and consulting a content index that may span
+// sibling images from the same manifest list.
+func dedupeImage(sourceImage v1.Image, contentIndex map[string]*dedupedContent, baseLayer *mutate.Addendum, keepDespiteWhiteout map[int]map[string]bool, crossLayer bool, minDedupSize int64, hashAlgo string, compression string, reproducible bool, owner ownerSpec) (v1.Image, error) {
+	fmt.Println("loading manifest")
+	sourceManifest, err := sourceImage.Manifest()
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("loading config")
+	sourceConfigFile, err := sourceImage.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	sourceConfigFile.DeepCopy()
+
+	var sourceLayerHistory []v1.History
+	for _, h := range sourceConfigFile.History {
+		if h.EmptyLayer {
+			continue
+		}
+		if reproducible {
+			h.Created = v1.Time{Time: reproducibleTimestamp()}
+		}
+		sourceLayerHistory = append(sourceLayerHistory, h)
+	}
+	sourceDiffIDs := sourceConfigFile.RootFS.DiffIDs
+
+	fmt.Println("remove existing layers and history")
+	sourceConfigFile.History = nil
+	sourceConfigFile.RootFS.DiffIDs = nil
+
+	if reproducible {
+		sourceConfigFile.Created = v1.Time{Time: reproducibleTimestamp()}
+	}
+
+	fmt.Println("creating destination image")
+	destinationImage, err := mutate.ConfigFile(empty.Image, sourceConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if baseLayer != nil {
+		fmt.Println("prepending shared synthetic base layer")
+		destinationImage, err = mutate.Append(destinationImage, *baseLayer)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fmt.Println("filtering layers")
+	for i, sourceDiffID := range sourceDiffIDs {
+		fmt.Printf("reading layer %d\n", i)
+
+		sourceLayer, err := sourceImage.LayerByDiffID(sourceDiffID)
+		if err != nil {
+			return nil, err
+		}
+
+		sourceLayerType, err := sourceLayer.MediaType()
+		if err != nil {
+			return nil, err
+		}
+
+		var layer v1.Layer
+		layerMediaType := sourceLayerType
+		switch sourceLayerType {
+		case types.DockerForeignLayer:
+			layer = sourceLayer
+		default:
+			fmt.Println("filtering layer")
+			var opener tarball.Opener
+			if crossLayer {
+				opener = crossLayerFilteredLayer(sourceLayer, contentIndex, keepDespiteWhiteout[i], i, minDedupSize, hashAlgo, reproducible, owner)
+			} else {
+				opener = filteredLayer(sourceLayer, minDedupSize, hashAlgo, reproducible, owner)
+			}
+			layer, err = compressedLayerFromOpener(opener, compression)
+			if err != nil {
+				return nil, err
+			}
+			layerMediaType, err = layer.MediaType()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		annotations := sourceManifest.Layers[i].Annotations
+		if withChunks, ok := layer.(chunkAnnotations); ok {
+			chunkAnnos, err := withChunks.ChunkAnnotations()
+			if err != nil {
+				return nil, err
+			}
+			if len(chunkAnnos) > 0 {
+				annotations = mergeAnnotations(annotations, chunkAnnos)
+			}
+		}
+
+		fmt.Println("appending layer")
+		fmt.Printf("History: %s\n", sourceLayerHistory[i])
+		destinationImage, err = mutate.Append(destinationImage, mutate.Addendum{
+			Layer:       layer,
+			MediaType:   layerMediaType,
+			History:     sourceLayerHistory[i],
+			URLs:        sourceManifest.Layers[i].URLs,
+			Annotations: annotations,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return destinationImage, nil
+}
+
+// mergeAnnotations returns a new map combining base with extra, favoring
+// extra's values on key collision. Either argument may be nil.
+func mergeAnnotations(base, extra map[string]string) map[string]string {
+	merged := map[string]string{}
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range extra {
+		merged[k] = v
+	}
+	return merged
+}
+
+// dedupeIndex runs dedupeImage over every child of a manifest list, sharing
+// one cross-layer content index (and therefore one synthetic base layer)
+// across all of them, so e.g. 5 linux/* variants of the same image share
+// their common files in one blob instead of duplicating them per-arch.
+func dedupeIndex(sourceIndex v1.ImageIndex, crossLayer bool, minDedupSize int64, hashAlgo string, compression string, reproducible bool, owner ownerSpec) (v1.ImageIndex, error) {
+	indexManifest, err := sourceIndex.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]v1.Image, len(indexManifest.Manifests))
+	allDiffIDs := make([][]v1.Hash, len(indexManifest.Manifests))
+	for i, desc := range indexManifest.Manifests {
+		image, err := sourceIndex.Image(desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		images[i] = image
+
+		configFile, err := image.ConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		allDiffIDs[i] = configFile.RootFS.DiffIDs
+	}
+
+	var contentIndex map[string]*dedupedContent
+	var baseLayerAddendum *mutate.Addendum
+	var keepSets []map[int]map[string]bool
+	if crossLayer {
+		fmt.Println("building cross-layer content index across all manifest list children")
+		contentIndex, err = buildCrossLayerIndex(images, allDiffIDs, minDedupSize, hashAlgo)
+		if err != nil {
+			return nil, err
+		}
+
+		keepSets, err = buildWhiteoutKeepSets(images, allDiffIDs, contentIndex)
+		if err != nil {
+			return nil, err
+		}
+
+		baseLayer, savedBytes, err := buildBaseLayer(images, allDiffIDs, contentIndex, compression)
+		if err != nil {
+			return nil, err
+		}
+
+		if baseLayer != nil {
+			mediaType, annotations, err := baseLayerMediaTypeAndAnnotations(baseLayer)
+			if err != nil {
+				return nil, err
+			}
+
+			created := time.Now()
+			if reproducible {
+				created = reproducibleTimestamp()
+			}
+
+			fmt.Printf("sharing one synthetic base layer across %d children (saving %d bytes)\n", len(images), savedBytes)
+			baseLayerAddendum = &mutate.Addendum{
+				Layer:       baseLayer,
+				MediaType:   mediaType,
+				Annotations: annotations,
+				History: v1.History{
+					Created:   v1.Time{Time: created},
+					CreatedBy: "dedupe-image-layers --cross-layer",
+					Comment:   fmt.Sprintf("synthetic base layer shared across %d manifest list children, holding %d deduplicated file(s), saving %d bytes", len(images), len(contentIndex), savedBytes),
+				},
+			}
+		}
+	}
+	if keepSets == nil {
+		keepSets = make([]map[int]map[string]bool, len(images))
+	}
+
+	var destinationIndex v1.ImageIndex = empty.Index
+	for i, desc := range indexManifest.Manifests {
+		fmt.Printf("deduping child %d (%s)\n", i, desc.Platform)
+		destinationImage, err := dedupeImage(images[i], contentIndex, baseLayerAddendum, keepSets[i], crossLayer, minDedupSize, hashAlgo, compression, reproducible, owner)
+		if err != nil {
+			return nil, err
+		}
+
+		destinationIndex = mutate.AppendManifests(destinationIndex, mutate.IndexAddendum{
+			Add: destinationImage,
+			Descriptor: v1.Descriptor{
+				Platform:    desc.Platform,
+				Annotations: desc.Annotations,
+				URLs:        desc.URLs,
+			},
+		})
+	}
+
+	return destinationIndex, nil
+}
@@ -2,29 +2,36 @@ package main
 
 import (
 	"archive/tar"
-	"bytes"
-	"crypto/md5"
+	"crypto/sha256"
 	"flag"
 	"fmt"
-	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
-	"github.com/google/go-containerregistry/pkg/v1/daemon"
-	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
-	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/google/go-containerregistry/pkg/v1/types"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
+	"lukechampine.com/blake3"
 	"os"
+	"path"
+	"strings"
+	"time"
 )
 
 func main() {
-	sourceImageName := flag.String("source-ref", "", "image ref")
+	sourceImageName := flag.String("source-ref", "", "image ref, or a transport-prefixed source: oci-layout:<dir>, oci-archive:<tar>, docker-archive:<tar>")
 	destinationImageName := flag.String("destination-ref", "", "image ref")
 	remote := flag.Bool("remote", false, "remote to registry")
+	crossLayer := flag.Bool("cross-layer", false, "dedupe file contents that repeat across layers into a synthetic shared base layer")
+	minDedupSize := flag.Int64("min-dedup-size", 10000, "minimum file size in bytes to consider for dedup")
+	hashAlgo := flag.String("hash", "sha256", "content hash used to identify duplicate files: sha256 or blake3")
+	output := flag.String("output", "", "where to write the result: daemon (default, or remote when -remote is set), remote, oci-layout:<dir>, oci-archive:<tar>, docker-archive:<tar>")
+	compression := flag.String("compression", compressionGzip, "layer compression: gzip, zstd, or zstd-chunked")
+	reproducible := flag.Bool("reproducible", false, "normalize tar entry order, timestamps, and ownership so identical input produces a byte-identical output")
+	reproducibleOwner := flag.String("reproducible-owner", "0:0", "uid:gid[:uname[:gname]] applied to every tar entry of the filtered layers in --reproducible mode; the --cross-layer synthetic base layer keeps its entries' original ownership")
 	flag.Parse()
 
 	if *sourceImageName == "" {
@@ -32,131 +39,174 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err := run(*sourceImageName, *destinationImageName, *remote); err != nil {
+	switch *hashAlgo {
+	case "sha256", "blake3":
+	default:
+		log.Fatalf("unsupported -hash %q, must be sha256 or blake3", *hashAlgo)
+	}
+
+	switch *compression {
+	case compressionGzip, compressionZstd, compressionZstdChunked:
+	default:
+		log.Fatalf("unsupported -compression %q, must be gzip, zstd, or zstd-chunked", *compression)
+	}
+
+	owner, err := parseOwnerSpec(*reproducibleOwner)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := run(*sourceImageName, *destinationImageName, *remote, *crossLayer, *minDedupSize, *hashAlgo, *output, *compression, *reproducible, owner); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func run(sourceImageName, destinationImageName string, isRemote bool) error {
-	var sourceImage v1.Image
-	sourceRef, err := name.ParseReference(sourceImageName, name.WeakValidation)
-	if err != nil {
-		return err
+// newHasher returns the hash.Hash backing the configured -hash flag. blake3
+// trades the stronger collision resistance most users don't need for
+// considerably faster throughput on large layers.
+func newHasher(hashAlgo string) hash.Hash {
+	switch hashAlgo {
+	case "blake3":
+		return blake3.New(32, nil)
+	default:
+		return sha256.New()
 	}
-	destinationTag, err := name.NewTag(destinationImageName)
+}
+
+func run(sourceImageName, destinationImageName string, isRemote, crossLayer bool, minDedupSize int64, hashAlgo string, output string, compression string, reproducible bool, owner ownerSpec) error {
+	sourceImage, sourceIndex, err := loadSource(sourceImageName, isRemote)
 	if err != nil {
 		return err
 	}
 
-	if isRemote {
-		fmt.Printf("loading remote image %s\n", sourceImageName)
-		sourceImage, err = remote.Image(sourceRef, remote.WithAuthFromKeychain(authn.DefaultKeychain))
-		if err != nil {
-			return err
-		}
-	} else {
-		fmt.Printf("loading daemon image %s\n", sourceImageName)
-		sourceImage, err = daemon.Image(sourceRef, daemon.WithUnbufferedOpener())
-		if err != nil {
-			return err
-		}
-	}
-
-	fmt.Println("loading manifest")
-	sourceManifest, err := sourceImage.Manifest()
+	destinationTag, err := name.NewTag(destinationImageName)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("loading config")
-	sourceConfigFile, err := sourceImage.ConfigFile()
+	sink, err := parseSink(output, isRemote)
 	if err != nil {
 		return err
 	}
-	sourceConfigFile.DeepCopy()
 
-	var sourceLayerHistory []v1.History
-	for _, h := range sourceConfigFile.History {
-		if h.EmptyLayer {
-			continue
+	if sourceIndex != nil {
+		fmt.Println("source is a manifest list, deduping each child image")
+		destinationIndex, err := dedupeIndex(sourceIndex, crossLayer, minDedupSize, hashAlgo, compression, reproducible, owner)
+		if err != nil {
+			return err
 		}
-		sourceLayerHistory = append(sourceLayerHistory, h)
+		return sink.WriteIndex(destinationIndex, destinationTag)
 	}
-	sourceDiffIDs := sourceConfigFile.RootFS.DiffIDs
-
-	fmt.Println("remove existing layers and history")
-	sourceConfigFile.History = nil
-	sourceConfigFile.RootFS.DiffIDs = nil
 
-	fmt.Println("creating destination image")
-	destinationImage, err := mutate.ConfigFile(empty.Image, sourceConfigFile)
-	if err != nil {
-		return err
-	}
+	var contentIndex map[string]*dedupedContent
+	var baseLayerAddendum *mutate.Addendum
+	var keepDespiteWhiteout map[int]map[string]bool
+	if crossLayer {
+		fmt.Println("building cross-layer content index")
+		configFile, err := sourceImage.ConfigFile()
+		if err != nil {
+			return err
+		}
+		diffIDs := configFile.RootFS.DiffIDs
 
-	fmt.Println("filtering layers")
-	for i, sourceDiffID := range sourceDiffIDs {
-		fmt.Printf("reading layer %d\n", i)
+		contentIndex, err = buildCrossLayerIndex([]v1.Image{sourceImage}, [][]v1.Hash{diffIDs}, minDedupSize, hashAlgo)
+		if err != nil {
+			return err
+		}
 
-		sourceLayer, err := sourceImage.LayerByDiffID(sourceDiffID)
+		keepSets, err := buildWhiteoutKeepSets([]v1.Image{sourceImage}, [][]v1.Hash{diffIDs}, contentIndex)
 		if err != nil {
 			return err
 		}
+		keepDespiteWhiteout = keepSets[0]
 
-		sourceLayerType, err := sourceLayer.MediaType()
+		baseLayer, savedBytes, err := buildBaseLayer([]v1.Image{sourceImage}, [][]v1.Hash{diffIDs}, contentIndex, compression)
 		if err != nil {
 			return err
 		}
 
-		var layer v1.Layer
-		switch sourceLayerType {
-		case types.DockerForeignLayer:
-			layer = sourceLayer
-		default:
-			fmt.Println("filtering layer")
-			layer, err = tarball.LayerFromOpener(filteredLayer(sourceLayer), tarball.WithCompressionLevel(9), tarball.WithCompressedCaching)
+		if baseLayer != nil {
+			mediaType, annotations, err := baseLayerMediaTypeAndAnnotations(baseLayer)
 			if err != nil {
 				return err
 			}
+
+			created := time.Now()
+			if reproducible {
+				created = reproducibleTimestamp()
+			}
+
+			fmt.Printf("prepending synthetic base layer (saving %d bytes across layers)\n", savedBytes)
+			baseLayerAddendum = &mutate.Addendum{
+				Layer:       baseLayer,
+				MediaType:   mediaType,
+				Annotations: annotations,
+				History: v1.History{
+					Created:   v1.Time{Time: created},
+					CreatedBy: "dedupe-image-layers --cross-layer",
+					Comment:   fmt.Sprintf("synthetic base layer holding %d deduplicated file(s), saving %d bytes across source layers", len(contentIndex), savedBytes),
+				},
+			}
 		}
+	}
 
-		fmt.Println("appending layer")
-		fmt.Printf("History: %s\n", sourceLayerHistory[i])
-		destinationImage, err = mutate.Append(destinationImage, mutate.Addendum{
-			Layer:       layer,
-			MediaType:   sourceLayerType,
-			History:     sourceLayerHistory[i],
-			URLs:        sourceManifest.Layers[i].URLs,
-			Annotations: sourceManifest.Layers[i].Annotations,
-		})
+	destinationImage, err := dedupeImage(sourceImage, contentIndex, baseLayerAddendum, keepDespiteWhiteout, crossLayer, minDedupSize, hashAlgo, compression, reproducible, owner)
+	if err != nil {
+		return err
 	}
 
-	if isRemote {
-		fmt.Printf("writing remote image %s\n", destinationImageName)
-		if err := remote.Write(destinationTag, destinationImage, remote.WithAuthFromKeychain(authn.DefaultKeychain)); err != nil {
-			return err
+	return sink.Write(destinationImage, destinationTag)
+}
+
+// hashLayerCandidates makes a first, hash-only pass over the layer's tar
+// stream, recording the content digest of every regular file at or above
+// minDedupSize. Nothing is buffered here beyond the running hash state, so
+// this pass costs O(1) memory regardless of file size.
+func hashLayerCandidates(layerReader io.Reader, minDedupSize int64, hashAlgo string) (map[string]string, error) {
+	pathDigests := map[string]string{}
+
+	tarReader := tar.NewReader(layerReader)
+	for {
+		tarHeader, err := tarReader.Next()
+		if err == io.EOF {
+			return pathDigests, nil
 		}
-	} else {
-		fmt.Printf("writing daemon image %s\n", destinationImageName)
-		output, err := daemon.Write(destinationTag, destinationImage)
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		if tarHeader.Typeflag != tar.TypeReg || tarHeader.Size < minDedupSize {
+			continue
 		}
-		io.Copy(os.Stdout, bytes.NewBuffer([]byte(output)))
-	}
 
-	return nil
+		hasher := newHasher(hashAlgo)
+		if _, err := io.Copy(hasher, tarReader); err != nil {
+			return nil, err
+		}
+		pathDigests[tarHeader.Name] = fmt.Sprintf("%x", hasher.Sum(nil))
+	}
 }
 
-func filteredLayer(originalLayer v1.Layer) tarball.Opener {
+func filteredLayer(originalLayer v1.Layer, minDedupSize int64, hashAlgo string, reproducible bool, owner ownerSpec) tarball.Opener {
 	return func() (io.ReadCloser, error) {
-		pipeReader, pipeWriter := io.Pipe()
 		fmt.Println("loading layer")
+		hashingReader, err := originalLayer.Uncompressed()
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Println("hashing layer")
+		pathDigests, err := hashLayerCandidates(hashingReader, minDedupSize, hashAlgo)
+		hashingReader.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		pipeReader, pipeWriter := io.Pipe()
 		layerReader, err := originalLayer.Uncompressed()
 		if err != nil {
 			return nil, err
 		}
-		fmt.Println("...done")
 
 		tarReader := tar.NewReader(layerReader)
 
@@ -164,104 +214,403 @@ func filteredLayer(originalLayer v1.Layer) tarball.Opener {
 			fmt.Println("filtering layer")
 			tarWriter := tar.NewWriter(pipeWriter)
 
-			hardLinkSources := map[string]string{}
-			var savedSpace int64
-			i := 0
-			for {
-				i++
-				tarHeader, err := tarReader.Next()
+			var writeErr error
+			if reproducible {
+				writeErr = writeReproducibleTar(tarReader, tarWriter, pathDigests, owner)
+			} else {
+				writeErr = writeFilteredTar(tarReader, tarWriter, pathDigests)
+			}
+			if writeErr != nil {
+				panic(writeErr)
+			}
 
-				if err == io.EOF {
-					fmt.Printf("done filtering (saved %d bytes)\n", savedSpace)
+			if err := tarWriter.Close(); err != nil {
+				panic(err)
+			}
+			if err := pipeWriter.CloseWithError(io.EOF); err != nil {
+				panic(err)
+			}
+		}()
 
-					if err := tarWriter.Close(); err != nil {
-						panic(err)
-					}
-					if err := pipeWriter.CloseWithError(io.EOF); err != nil {
-						panic(err)
-					}
+		return ioutil.NopCloser(pipeReader), nil
+	}
+}
 
-					return
+// dedupedContent tracks every place a given content digest was seen across the
+// whole image so a single canonical copy can be hoisted into a shared base layer.
+type dedupedContent struct {
+	count           int
+	firstImageIndex int
+	firstLayerIndex int
+	firstPath       string
+	size            int64
+}
+
+// buildCrossLayerIndex walks every layer of every image once, hashing the
+// contents of each regular file at or above minDedupSize with the configured
+// algorithm, so files that
+// repeat across layer (and image) boundaries can be found. Passing every
+// child of a manifest list through a single call lets a fat manifest's
+// variants share one synthetic base layer. count only ever grows once per
+// layer a digest is seen in: a hardlink group within a single layer already
+// shares storage there and is never itself hoisted, so its replicas (and any
+// other same-digest duplicate within the one layer) contribute nothing
+// beyond the layer's first occurrence.
+func buildCrossLayerIndex(images []v1.Image, allDiffIDs [][]v1.Hash, minDedupSize int64, hashAlgo string) (map[string]*dedupedContent, error) {
+	index := map[string]*dedupedContent{}
+
+	for imageIndex, image := range images {
+		for i, sourceDiffID := range allDiffIDs[imageIndex] {
+			sourceLayer, err := image.LayerByDiffID(sourceDiffID)
+			if err != nil {
+				return nil, err
+			}
+
+			layerReader, err := sourceLayer.Uncompressed()
+			if err != nil {
+				return nil, err
+			}
+
+			seenInLayer := map[string]bool{} // digests already counted for this layer
+			tarReader := tar.NewReader(layerReader)
+			for {
+				tarHeader, err := tarReader.Next()
+				if err == io.EOF {
+					break
 				}
 				if err != nil {
-					panic(err)
-					//	if err := pipeWriter.CloseWithError(err); err != nil {
-					//		panic(err)
-					//	}
-					//	return
+					layerReader.Close()
+					return nil, err
 				}
 
-				isHardLinkCandidate := tarHeader.Typeflag == tar.TypeReg && tarHeader.Size > 10000
-
-				// copy normally if non-trivially-sized regular file
-				if !isHardLinkCandidate {
-					if err := tarWriter.WriteHeader(tarHeader); err != nil {
-						panic(err)
-						//if err := pipeWriter.CloseWithError(err); err != nil {
-						//	panic(err)
-						//}
-						return
-					}
+				if tarHeader.Typeflag == tar.TypeLink {
+					// an intra-layer hardlink replica of a file already hashed in
+					// this same layer; it shares storage with that file and is
+					// not itself a cross-layer repeat, so it is never counted
+					continue
+				}
 
-					if _, err := io.Copy(tarWriter, tarReader); err != nil {
-						panic(err)
-						//if err := pipeWriter.CloseWithError(err); err != nil {
-						//	panic(err)
-						//}
-						return
-					}
+				if tarHeader.Typeflag != tar.TypeReg || tarHeader.Size < minDedupSize {
 					continue
 				}
 
-				fileBuffer := &bytes.Buffer{}
-				hasher := md5.New()
-				multiWriter := io.MultiWriter(fileBuffer, hasher)
-				if _, err := io.Copy(multiWriter, tarReader); err != nil {
-					panic(err)
-					//if err := pipeWriter.CloseWithError(err); err != nil {
-					//	panic(err)
-					//}
+				hasher := newHasher(hashAlgo)
+				if _, err := io.Copy(hasher, tarReader); err != nil {
+					layerReader.Close()
+					return nil, err
+				}
+				digest := fmt.Sprintf("%x", hasher.Sum(nil))
 
-					return
+				if seenInLayer[digest] {
+					continue
 				}
+				seenInLayer[digest] = true
 
-				sum := fmt.Sprintf("%x", hasher.Sum(nil))
+				if entry, ok := index[digest]; ok {
+					entry.count++
+				} else {
+					index[digest] = &dedupedContent{
+						count:           1,
+						firstImageIndex: imageIndex,
+						firstLayerIndex: i,
+						firstPath:       tarHeader.Name,
+						size:            tarHeader.Size,
+					}
+				}
+			}
 
-				existingIdenticalPath := hardLinkSources[sum]
-				if existingIdenticalPath != "" {
-					fmt.Printf("link: %s => %s (%d)\n", tarHeader.Name, existingIdenticalPath, tarHeader.Size)
-					savedSpace += tarHeader.Size
+			layerReader.Close()
+		}
+	}
 
-					tarHeader.Typeflag = tar.TypeLink
-					tarHeader.Linkname = existingIdenticalPath
-					tarHeader.Size = 0
+	// drop anything that never repeats, it has nothing to hoist
+	for digest, entry := range index {
+		if entry.count <= 1 {
+			delete(index, digest)
+		}
+	}
 
-					if err := tarWriter.WriteHeader(tarHeader); err != nil {
-						panic(err)
-						//if err := pipeWriter.CloseWithError(err); err != nil {
-						//	panic(err)
-						//}
-						return
+	return index, nil
+}
+
+// buildBaseLayer re-reads the first-seen copy of every deduplicated file and
+// packs it into a single synthetic layer meant to be prepended to every
+// image that shares contentIndex, so overlayfs can serve the shared content
+// from one place instead of N.
+func buildBaseLayer(images []v1.Image, allDiffIDs [][]v1.Hash, contentIndex map[string]*dedupedContent, compression string) (v1.Layer, int64, error) {
+	if len(contentIndex) == 0 {
+		return nil, 0, nil
+	}
+
+	// imageIndex -> layer index -> path -> digest
+	wanted := map[int]map[int]map[string]string{}
+	var savedBytes int64
+	for digest, entry := range contentIndex {
+		if wanted[entry.firstImageIndex] == nil {
+			wanted[entry.firstImageIndex] = map[int]map[string]string{}
+		}
+		if wanted[entry.firstImageIndex][entry.firstLayerIndex] == nil {
+			wanted[entry.firstImageIndex][entry.firstLayerIndex] = map[string]string{}
+		}
+		wanted[entry.firstImageIndex][entry.firstLayerIndex][entry.firstPath] = digest
+		savedBytes += entry.size * int64(entry.count-1)
+	}
+
+	opener := func() (io.ReadCloser, error) {
+		pipeReader, pipeWriter := io.Pipe()
+
+		go func() {
+			tarWriter := tar.NewWriter(pipeWriter)
+
+			for imageIndex, image := range images {
+				for i, sourceDiffID := range allDiffIDs[imageIndex] {
+					paths := wanted[imageIndex][i]
+					if len(paths) == 0 {
+						continue
 					}
-				} else {
-					hardLinkSources[sum] = tarHeader.Name
 
-					if err := tarWriter.WriteHeader(tarHeader); err != nil {
-						panic(err)
-						//if err := pipeWriter.CloseWithError(err); err != nil {
-						//	panic(err)
-						//}
+					sourceLayer, err := image.LayerByDiffID(sourceDiffID)
+					if err != nil {
+						pipeWriter.CloseWithError(err)
 						return
 					}
 
-					if _, err := io.Copy(tarWriter, fileBuffer); err != nil {
-						panic(err)
-						//if err := pipeWriter.CloseWithError(err); err != nil {
-						//	panic(err)
-						//}
+					layerReader, err := sourceLayer.Uncompressed()
+					if err != nil {
+						pipeWriter.CloseWithError(err)
 						return
 					}
+
+					tarReader := tar.NewReader(layerReader)
+					for {
+						tarHeader, err := tarReader.Next()
+						if err == io.EOF {
+							break
+						}
+						if err != nil {
+							layerReader.Close()
+							pipeWriter.CloseWithError(err)
+							return
+						}
+
+						if _, ok := paths[tarHeader.Name]; !ok {
+							continue
+						}
+
+						if err := tarWriter.WriteHeader(tarHeader); err != nil {
+							layerReader.Close()
+							pipeWriter.CloseWithError(err)
+							return
+						}
+						if _, err := io.Copy(tarWriter, tarReader); err != nil {
+							layerReader.Close()
+							pipeWriter.CloseWithError(err)
+							return
+						}
+					}
+
+					layerReader.Close()
+				}
+			}
+
+			if err := tarWriter.Close(); err != nil {
+				pipeWriter.CloseWithError(err)
+				return
+			}
+			pipeWriter.CloseWithError(io.EOF)
+		}()
+
+		return ioutil.NopCloser(pipeReader), nil
+	}
+
+	baseLayer, err := compressedLayerFromOpener(opener, compression)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return baseLayer, savedBytes, nil
+}
+
+// whiteoutPrefix marks the removal of a sibling entry in the Docker/OCI tar
+// layer whiteout convention: a file named ".wh.<base>" in a directory means
+// the entry "<base>" in that same directory no longer exists at this layer.
+const whiteoutPrefix = ".wh."
+
+// whiteoutOpaqueMarker marks an entire directory as emptied of everything
+// beneath it in lower layers. It isn't tied to a single path, so it's not
+// handled by whiteoutTarget/buildWhiteoutKeepSets below.
+const whiteoutOpaqueMarker = ".wh..wh..opq"
+
+// whiteoutTarget returns the path a whiteout entry masks and true, or ("",
+// false) if name isn't a (non-opaque) whiteout entry.
+func whiteoutTarget(name string) (string, bool) {
+	dir, base := path.Split(name)
+	if base == whiteoutOpaqueMarker || !strings.HasPrefix(base, whiteoutPrefix) {
+		return "", false
+	}
+	return dir + strings.TrimPrefix(base, whiteoutPrefix), true
+}
+
+// buildWhiteoutKeepSets re-walks every image's layers in order, once per
+// image, to find canonical paths that get whited out and then re-created
+// further up the same layer stack. A whiteout below the current layer
+// already hides the synthetic base layer's copy of that path from
+// everything above it, so the re-created entry must be kept (written with
+// its real data) rather than omitted as "already served by the base layer" -
+// omitting it would leave the path missing from the merged filesystem
+// entirely. The returned slice has one entry per image, keyed by layer
+// index and then path.
+func buildWhiteoutKeepSets(images []v1.Image, allDiffIDs [][]v1.Hash, contentIndex map[string]*dedupedContent) ([]map[int]map[string]bool, error) {
+	keepSets := make([]map[int]map[string]bool, len(images))
+	if len(contentIndex) == 0 {
+		return keepSets, nil
+	}
+
+	canonicalPaths := map[string]string{}
+	for digest, entry := range contentIndex {
+		canonicalPaths[entry.firstPath] = digest
+	}
+
+	for imageIndex, image := range images {
+		keepSets[imageIndex] = map[int]map[string]bool{}
+		maskedByWhiteout := map[string]bool{}
+
+		for i, sourceDiffID := range allDiffIDs[imageIndex] {
+			sourceLayer, err := image.LayerByDiffID(sourceDiffID)
+			if err != nil {
+				return nil, err
+			}
+
+			layerReader, err := sourceLayer.Uncompressed()
+			if err != nil {
+				return nil, err
+			}
+
+			tarReader := tar.NewReader(layerReader)
+			for {
+				tarHeader, err := tarReader.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					layerReader.Close()
+					return nil, err
+				}
+
+				if target, isWhiteout := whiteoutTarget(tarHeader.Name); isWhiteout {
+					if _, ok := canonicalPaths[target]; ok {
+						maskedByWhiteout[target] = true
+					}
+					continue
+				}
+
+				if tarHeader.Typeflag != tar.TypeReg || tarHeader.Size == 0 {
+					continue
+				}
+				if _, ok := canonicalPaths[tarHeader.Name]; !ok || !maskedByWhiteout[tarHeader.Name] {
+					continue
+				}
+
+				if keepSets[imageIndex][i] == nil {
+					keepSets[imageIndex][i] = map[string]bool{}
 				}
+				keepSets[imageIndex][i][tarHeader.Name] = true
+				maskedByWhiteout[tarHeader.Name] = false
+			}
+
+			layerReader.Close()
+		}
+	}
+
+	return keepSets, nil
+}
+
+// baseLayerMediaTypeAndAnnotations derives the descriptor MediaType and any
+// extra annotations (e.g. zstd-chunked's manifest-checksum/position pair)
+// that a synthetic base layer addendum needs from baseLayer's own
+// compression, the same way dedupeImage derives them for every other layer
+// it appends. Getting this wrong means the base layer's manifest entry lies
+// about its own compression, or a zstd-chunked base layer ships with no
+// chunk manifest annotations at all.
+func baseLayerMediaTypeAndAnnotations(baseLayer v1.Layer) (types.MediaType, map[string]string, error) {
+	mediaType, err := baseLayer.MediaType()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var annotations map[string]string
+	if withChunks, ok := baseLayer.(chunkAnnotations); ok {
+		chunkAnnos, err := withChunks.ChunkAnnotations()
+		if err != nil {
+			return "", nil, err
+		}
+		if len(chunkAnnos) > 0 {
+			annotations = chunkAnnos
+		}
+	}
+
+	return mediaType, annotations, nil
+}
+
+// crossLayerFilteredLayer drops any entry from layerIndex whose path and
+// content digest both match a canonical copy in the synthetic base layer,
+// whether this is a later occurrence or the first one that was hoisted; the
+// same content under any other path is kept. The lookup is keyed by (path, digest), not path alone, so an entry that
+// merely collides on path with an unrelated canonical file elsewhere is
+// never dropped - only a byte-for-byte match is - and keepPaths (from
+// buildWhiteoutKeepSets) overrides an omission that would otherwise resurface
+// content an earlier layer's whiteout already hid. Everything that survives
+// omission still goes through the same intra-layer hardlink-by-digest pass
+// filteredLayer does, via the same hash-only pre-pass, so files that only
+// repeat within this one layer are deduplicated the same as without
+// --cross-layer.
+func crossLayerFilteredLayer(originalLayer v1.Layer, contentIndex map[string]*dedupedContent, keepPaths map[string]bool, layerIndex int, minDedupSize int64, hashAlgo string, reproducible bool, owner ownerSpec) tarball.Opener {
+	canonicalPaths := map[string]string{}
+	for digest, entry := range contentIndex {
+		canonicalPaths[entry.firstPath] = digest
+	}
+
+	return func() (io.ReadCloser, error) {
+		fmt.Println("loading layer")
+		hashingReader, err := originalLayer.Uncompressed()
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Println("hashing layer")
+		pathDigests, err := hashLayerCandidates(hashingReader, minDedupSize, hashAlgo)
+		hashingReader.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		pipeReader, pipeWriter := io.Pipe()
+		layerReader, err := originalLayer.Uncompressed()
+		if err != nil {
+			return nil, err
+		}
+
+		tarReader := tar.NewReader(layerReader)
+
+		go func() {
+			fmt.Println("filtering layer")
+			tarWriter := tar.NewWriter(pipeWriter)
+
+			var writeErr error
+			if reproducible {
+				writeErr = writeCrossLayerReproducibleTar(tarReader, tarWriter, pathDigests, canonicalPaths, keepPaths, layerIndex, owner)
+			} else {
+				writeErr = writeCrossLayerFilteredTar(tarReader, tarWriter, pathDigests, canonicalPaths, keepPaths, layerIndex)
+			}
+			if writeErr != nil {
+				panic(writeErr)
+			}
+
+			if err := tarWriter.Close(); err != nil {
+				panic(err)
+			}
+			if err := pipeWriter.CloseWithError(io.EOF); err != nil {
+				panic(err)
 			}
 		}()
 
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// ImageSink writes a finished image (or, for manifest lists, a whole index)
+// somewhere: the local docker daemon, a remote registry, or a file on disk
+// in one of the OCI/docker archive formats. This mirrors the transports
+// skopeo/containers-image offer.
+type ImageSink interface {
+	Write(image v1.Image, ref name.Reference) error
+	WriteIndex(index v1.ImageIndex, ref name.Reference) error
+}
+
+// parseSink parses an --output value of the form "oci-layout:<dir>",
+// "oci-archive:<tar>", or "docker-archive:<tar>". A bare "", "daemon", or
+// "remote" selects the original daemon/registry writers, with isRemote
+// breaking the tie for "" so existing --remote users see no change.
+func parseSink(output string, isRemote bool) (ImageSink, error) {
+	parts := strings.SplitN(output, ":", 2)
+
+	switch parts[0] {
+	case "":
+		if isRemote {
+			return remoteSink{}, nil
+		}
+		return daemonSink{}, nil
+
+	case "daemon":
+		return daemonSink{}, nil
+
+	case "remote":
+		return remoteSink{}, nil
+
+	case "oci-layout":
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("oci-layout output requires a directory, e.g. oci-layout:/path/to/dir")
+		}
+		return ociLayoutSink{dir: parts[1]}, nil
+
+	case "oci-archive":
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("oci-archive output requires a tar path, e.g. oci-archive:/path/to/image.tar")
+		}
+		return ociArchiveSink{tarPath: parts[1]}, nil
+
+	case "docker-archive":
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("docker-archive output requires a tar path, e.g. docker-archive:/path/to/image.tar")
+		}
+		return dockerArchiveSink{tarPath: parts[1]}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported --output %q", output)
+	}
+}
+
+type daemonSink struct{}
+
+func (daemonSink) Write(image v1.Image, ref name.Reference) error {
+	tag, ok := ref.(name.Tag)
+	if !ok {
+		return fmt.Errorf("daemon output requires a tag reference, got %s", ref)
+	}
+
+	fmt.Printf("writing daemon image %s\n", ref)
+	out, err := daemon.Write(tag, image)
+	if err != nil {
+		return err
+	}
+	fmt.Println(out)
+	return nil
+}
+
+func (daemonSink) WriteIndex(index v1.ImageIndex, ref name.Reference) error {
+	return fmt.Errorf("daemon output does not support multi-arch manifest lists, use --output remote or an oci-* sink")
+}
+
+type remoteSink struct{}
+
+func (remoteSink) Write(image v1.Image, ref name.Reference) error {
+	fmt.Printf("writing remote image %s\n", ref)
+	return remote.Write(ref, image, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+}
+
+func (remoteSink) WriteIndex(index v1.ImageIndex, ref name.Reference) error {
+	fmt.Printf("writing remote index %s\n", ref)
+	return remote.WriteIndex(ref, index, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+}
+
+type ociLayoutSink struct {
+	dir string
+}
+
+func (s ociLayoutSink) Write(image v1.Image, ref name.Reference) error {
+	fmt.Printf("writing oci-layout %s\n", s.dir)
+	index := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: image})
+	_, err := layout.Write(s.dir, index)
+	return err
+}
+
+func (s ociLayoutSink) WriteIndex(index v1.ImageIndex, ref name.Reference) error {
+	fmt.Printf("writing oci-layout %s\n", s.dir)
+	_, err := layout.Write(s.dir, index)
+	return err
+}
+
+type ociArchiveSink struct {
+	tarPath string
+}
+
+func (s ociArchiveSink) Write(image v1.Image, ref name.Reference) error {
+	fmt.Printf("writing oci-archive %s\n", s.tarPath)
+
+	dir, err := ioutil.TempDir("", "dedupe-image-layers-oci-dst-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	index := mutate.AppendManifests(empty.Index, mutate.IndexAddendum{Add: image})
+	if _, err := layout.Write(dir, index); err != nil {
+		return err
+	}
+
+	return tarDirectory(dir, s.tarPath)
+}
+
+func (s ociArchiveSink) WriteIndex(index v1.ImageIndex, ref name.Reference) error {
+	fmt.Printf("writing oci-archive %s\n", s.tarPath)
+
+	dir, err := ioutil.TempDir("", "dedupe-image-layers-oci-dst-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := layout.Write(dir, index); err != nil {
+		return err
+	}
+
+	return tarDirectory(dir, s.tarPath)
+}
+
+type dockerArchiveSink struct {
+	tarPath string
+}
+
+func (s dockerArchiveSink) Write(image v1.Image, ref name.Reference) error {
+	tag, ok := ref.(name.Tag)
+	if !ok {
+		return fmt.Errorf("docker-archive output requires a tag reference, got %s", ref)
+	}
+
+	fmt.Printf("writing docker-archive %s\n", s.tarPath)
+	return tarball.WriteToFile(s.tarPath, tag, image)
+}
+
+func (s dockerArchiveSink) WriteIndex(index v1.ImageIndex, ref name.Reference) error {
+	return fmt.Errorf("docker-archive output does not support multi-arch manifest lists, use --output remote or an oci-* sink")
+}
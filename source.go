@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// loadSource resolves sourceImageName into either a single v1.Image or,
+// when it names a multi-arch manifest list or a multi-image archive, a
+// v1.ImageIndex. Exactly one of the two return values is non-nil. A
+// transport prefix (oci-layout:, oci-archive:, docker-archive:) selects a
+// local filesystem source mirroring the --output sinks in sink.go; anything
+// else is treated as an image reference loaded from the daemon or a remote
+// registry, same as before isRemote existed as the only knob.
+func loadSource(sourceImageName string, isRemote bool) (v1.Image, v1.ImageIndex, error) {
+	parts := strings.SplitN(sourceImageName, ":", 2)
+
+	switch parts[0] {
+	case "oci-layout":
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("oci-layout source requires a directory, e.g. oci-layout:/path/to/dir")
+		}
+		fmt.Printf("loading oci-layout image %s\n", parts[1])
+		p, err := layout.FromPath(parts[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		return splitLayoutSource(p)
+
+	case "oci-archive":
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("oci-archive source requires a tar path, e.g. oci-archive:/path/to/image.tar")
+		}
+		fmt.Printf("loading oci-archive image %s\n", parts[1])
+		dir, err := ioutil.TempDir("", "dedupe-image-layers-oci-src-")
+		if err != nil {
+			return nil, nil, err
+		}
+		// dir is not removed: the returned image reads its manifest, config
+		// and layer blobs from it lazily, after loadSource has returned.
+
+		if err := untarDirectory(parts[1], dir); err != nil {
+			return nil, nil, err
+		}
+		p, err := layout.FromPath(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		return splitLayoutSource(p)
+
+	case "docker-archive":
+		if len(parts) != 2 {
+			return nil, nil, fmt.Errorf("docker-archive source requires a tar path, e.g. docker-archive:/path/to/image.tar")
+		}
+		fmt.Printf("loading docker-archive image %s\n", parts[1])
+		return loadDockerArchiveSource(parts[1])
+
+	default:
+		sourceRef, err := name.ParseReference(sourceImageName, name.WeakValidation)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if isRemote {
+			fmt.Printf("loading remote image %s\n", sourceImageName)
+			descriptor, err := remote.Get(sourceRef, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+			if err != nil {
+				return nil, nil, err
+			}
+			if descriptor.MediaType.IsIndex() {
+				index, err := descriptor.ImageIndex()
+				return nil, index, err
+			}
+			image, err := descriptor.Image()
+			return image, nil, err
+		}
+
+		fmt.Printf("loading daemon image %s\n", sourceImageName)
+		image, err := daemon.Image(sourceRef, daemon.WithUnbufferedOpener())
+		return image, nil, err
+	}
+}
+
+// splitLayoutSource returns an OCI layout's single image, or, when its root
+// index describes more than one manifest (a multi-arch layout), the index
+// itself.
+func splitLayoutSource(p layout.Path) (v1.Image, v1.ImageIndex, error) {
+	index, err := p.ImageIndex()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(manifest.Manifests) == 0 {
+		return nil, nil, fmt.Errorf("oci-layout contains no images")
+	}
+	if len(manifest.Manifests) > 1 {
+		return nil, index, nil
+	}
+
+	image, err := index.Image(manifest.Manifests[0].Digest)
+	return image, nil, err
+}
+
+// loadDockerArchiveSource inspects a "docker save"-style tar's manifest.json
+// for its repo tags. A single tag loads as a plain v1.Image as before; more
+// than one is reassembled into a v1.ImageIndex so multi-image archives can
+// be deduped the same way a registry manifest list is.
+func loadDockerArchiveSource(tarPath string) (v1.Image, v1.ImageIndex, error) {
+	manifests, err := tarball.LoadManifest(func() (io.ReadCloser, error) {
+		return os.Open(tarPath)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var tags []string
+	for _, m := range manifests {
+		tags = append(tags, m.RepoTags...)
+	}
+
+	if len(tags) <= 1 {
+		image, err := tarball.ImageFromPath(tarPath, nil)
+		return image, nil, err
+	}
+
+	var index v1.ImageIndex = empty.Index
+	for _, rawTag := range tags {
+		tag, err := name.NewTag(rawTag)
+		if err != nil {
+			return nil, nil, err
+		}
+		image, err := tarball.ImageFromPath(tarPath, &tag)
+		if err != nil {
+			return nil, nil, err
+		}
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{Add: image})
+	}
+
+	return nil, index, nil
+}